@@ -20,6 +20,7 @@ import (
 	"flag"
 	"net/http"
 	"os"
+	"strings"
 	"time"
 
 	"fortio.org/cli"
@@ -40,6 +41,41 @@ func (f *headersFlagList) Set(value string) error {
 
 // -- end of functions for -H support
 
+// -- Support for multiple instances of -cacert flag on cmd line.
+type caCertFlagList struct{}
+
+func (f *caCertFlagList) String() string {
+	return ""
+}
+
+func (f *caCertFlagList) Set(value string) error {
+	config.CAFiles = append(config.CAFiles, value)
+	return nil
+}
+
+// -- Support for multiple instances of -unix-socket flag on cmd line.
+type unixSocketFlagList struct{}
+
+func (f *unixSocketFlagList) String() string {
+	return ""
+}
+
+func (f *unixSocketFlagList) Set(value string) error {
+	config.UnixSockets = append(config.UnixSockets, value)
+	return nil
+}
+
+// -- Support for multiple instances of -pin flag on cmd line.
+type pinsFlagList struct{}
+
+func (f *pinsFlagList) String() string {
+	return ""
+}
+
+func (f *pinsFlagList) Set(value string) error {
+	return config.AddPin(value)
+}
+
 var config = mc.NewConfig()
 
 // Main is the main function for the multicurl tool so it can be called from testscript.
@@ -56,9 +92,27 @@ func Main() int {
 	flag.Var(&headersFlags, "H",
 		"Additional http header(s). Multiple `key:value` pairs can be passed using multiple -H.")
 	output := flag.String("o", "", "Output `file name pattern`, e.g \"out-%.html\" where % will be replaced by the ip, "+
+		"or using placeholders {ip}, {port}, {host}, {iter}, {code}, {family}, {index}, {ts} "+
+		"e.g \"{host}/{ip}-{iter}.html\", "+
 		"default is stdout, use \"none\" for no output (in combination with -json for instance)")
+	dumpHeaders := flag.String("dump-headers", "",
+		"Save the response headers of each IP to a separate `file name pattern` (same placeholders as -o), - for stdout")
+	dumpRequest := flag.Bool("dump-request", false,
+		"Also write the request sent before the response headers in -dump-headers")
 	data := flag.String("d", "", "Payload to POST, use @filename to read from file")
-	ipInput := flag.String("I", "", "IP address `file` to use instead of resolving the URL, use - for stdin")
+	proxyFlag := flag.String("proxy", "",
+		"Proxy `url` to connect to each IP through: http:// or https:// (CONNECT to the IP:port) or socks5://")
+	ifaceFlag := flag.String("interface", "",
+		"Network interface `name` to bind the connections to (Linux only), -local-addr can also be used with it")
+	localAddrFlag := flag.String("local-addr", "",
+		"Comma separated `list` of local IPs (or interface names) to connect from, each IP is tried from each of them; "+
+			"\"all\" for all the local addresses")
+	ipInput := flag.String("I", "",
+		"IP address `file` to use instead of resolving the URL (can include unix:/path lines), use - for stdin")
+	var unixSocketFlags unixSocketFlagList
+	flag.Var(&unixSocketFlags, "unix-socket",
+		"Unix domain socket `path` to connect to instead of resolving the URL, @name for an abstract socket "+
+			"(can be repeated)")
 	expected := flag.Int("expected", 0,
 		"Expected HTTP return code, 0 means any and non 200s will be warning otherwise if set any different code is an error")
 	repeat := flag.Int("repeat", 0,
@@ -67,13 +121,83 @@ func Main() int {
 	maxIPs := flag.Int("n", 0, "Max number of IPs to use/try (0 means all the ones found)")
 	relookup := flag.Bool("relookup", false, "Re-lookup the URL between each repeat")
 	expiryThreshold := flag.Float64("cert-expiry", 7, "Certificate expiry error threshold in `days`")
-	caCertFlag := flag.String("cacert", "",
-		"Path to a custom CA certificate `file` to use instead of system ones.")
+	var caCertFlags caCertFlagList
+	flag.Var(&caCertFlags, "cacert",
+		"Path to a custom CA certificate `file` to use instead of system ones (can be repeated).")
+	caPathFlag := flag.String("capath", "",
+		"Path to a `directory` of custom CA certificates to use instead of system ones")
+	caAppendFlag := flag.Bool("ca-append", false,
+		"Add the -cacert and -capath CAs to the system ones instead of replacing them")
 	insecure := flag.Bool("insecure", false, "Skip verification of server certificate (insecure TLS)")
-	certFlag := flag.String("cert", "", "Path to a custom client certificate `file` for mTLS.")
+	certFlag := flag.String("cert", "",
+		"Path to a custom client certificate `file` for mTLS (PKCS#12 .p12 file or PEM including the key if no -key).")
 	keyFlag := flag.String("key", "", "Path to a custom client key `file` for mTLS.")
+	passEnvFlag := flag.String("pass-env", "",
+		"Name of the environment `variable` containing the password of the encrypted -key or PKCS#12 -cert")
+	passFileFlag := flag.String("pass-file", "",
+		"Path to a `file` containing the password of the encrypted -key or PKCS#12 -cert")
+	tlsMin := flag.String("tls-min", "", "Minimum TLS `version` (1.0, 1.1, 1.2 or 1.3)")
+	tlsMax := flag.String("tls-max", "", "Maximum TLS `version` (1.0, 1.1, 1.2 or 1.3)")
+	ciphers := flag.String("ciphers", "",
+		"Comma separated `list` of allowed TLS 1.0-1.2 cipher suites (e.g TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256)")
+	expectTLS := flag.String("expect-tls", "",
+		"Expected negotiated TLS `version` (e.g 1.3), any other version is an error")
+	tlsResume := flag.Bool("tls-resume", false,
+		"Share the TLS sessions between requests so they can be resumed (recorded per IP), not with -compare-certs")
+	tlsScan := flag.Bool("tls-scan", false,
+		"Scan which TLS versions each IP accepts (none is an error) instead of doing the HTTP request")
+	tlsScanCiphers := flag.Bool("tls-scan-ciphers", false,
+		"With -tls-scan also scan which TLS 1.0-1.2 cipher suites are accepted")
+	tlsForbid := flag.String("tls-forbid", "",
+		"Comma separated `versions` (e.g 1.0,1.1) that are errors if accepted by an IP during -tls-scan")
+	requireOCSP := flag.Bool("require-ocsp-staple", false, "Error if an IP doesn't staple a good OCSP response")
+	var pinsFlags pinsFlagList
+	flag.Var(&pinsFlags, "pin",
+		"Public key `sha256//base64` pin(s) one of which must be in each IP's certificate chain (repeat or separate with ;)")
+	sni := flag.String("sni", "",
+		"TLS server `name` indication to send instead of the Host, \"none\" to send none "+
+			"(certificate still verified against Host)")
+	vhosts := flag.String("vhosts", "",
+		"Comma separated `list` of virtual hosts (or @file with one per line) to check against the IPs of the url")
+	tlsOnly := flag.Bool("tls-only", false,
+		"Only connect and complete the TLS handshake with each IP, don't send any HTTP request")
+	tcpFlag := flag.Bool("tcp", false,
+		"Only connect to each IP:port (no TLS nor HTTP) and report the connect latency, sending the -d payload if any "+
+			"and reading the banner")
+	expectBanner := flag.String("expect-banner", "",
+		"Regular `expression` the banner read must match (read until it does or -request-timeout), requires -tcp")
+	compareCerts := flag.Bool("compare-certs", false,
+		"Group IPs by certificate fingerprint and error out if different IPs present different certificates")
+	compareChain := flag.Bool("compare-chain", false,
+		"With -compare-certs, compare the full presented chain instead of the leaf")
+	http2Flag := flag.Bool("http2", false,
+		"Alias for the default: negotiate HTTP/2 (using ALPN, over TLS only) with fallback to HTTP/1.1")
+	h2cFlag := flag.Bool("http2-prior-knowledge", false,
+		"Use HTTP/2 without negotiation (h2c for http:// urls, h2 without HTTP/1.1 fallback for https://)")
+	http11Flag := flag.Bool("http1.1", false, "Use HTTP/1.1 only, even over TLS")
+	http3Flag := flag.Bool("http3", false,
+		"Send the request over HTTP/3 (QUIC/UDP) to each IP and report success and timings")
+	followFlag := flag.Bool("L", false,
+		"Follow redirects, the ones to the same host stay pinned to the same IP (see -redirect-resolve for others)")
+	maxRedirs := flag.Int("max-redirs", 10, "Maximum number of redirects to follow with -L, more is an error")
+	redirectResolve := flag.Bool("redirect-resolve", false,
+		"With -L also follow redirects to other hosts (resolved normally), otherwise they are only reported")
+	altSvcProbe := flag.Bool("alt-svc-probe", false,
+		"Also send the request to each alternative service (h3, h2) advertised in the Alt-Svc header of each IP")
+	expectProto := flag.String("expect-proto", "",
+		"Expected HTTP protocol `version` of each response (e.g 2 or 1.1), any other is an error")
 	jsonFlag := flag.Bool("json", false, "JSON output of summary results")
 	noBarFlag := flag.Bool("nobar", false, "Disable display of progress bar (or spinner when no content-length)")
+	maxBodyFlag := flag.Int64("max-body-size", 0,
+		"Max number of `bytes` to read from each response body, 0 means no limit (bigger bodies are truncated)")
+	maxBodyErrFlag := flag.Bool("max-body-error", false,
+		"Treat bodies exceeding -max-body-size as errors instead of warnings")
+	hashFlag := flag.String("hash", "",
+		"Compute and record the `algorithm` (sha256, sha1 or md5) digest of each response body")
+	expSha256 := flag.String("expect-sha256", "",
+		"Expected sha256 `hex` digest of each response body (mismatches are errors), use @file.sha256 to read from file")
+	expSha1 := flag.String("expect-sha1", "", "Same as -expect-sha256 but for sha1 `hex` digest")
+	expMd5 := flag.String("expect-md5", "", "Same as -expect-sha256 but for md5 `hex` digest")
 
 	cli.ProgramName = "Fortio multicurl"
 	cli.ArgsHelp = "url"
@@ -97,7 +221,11 @@ func Main() int {
 	config.ResolveType = resolveType
 	config.IncludeHeaders = *inclHeaders
 	config.OutputPattern = *output
+	config.HeadersPattern = *dumpHeaders
+	config.DumpRequest = *dumpRequest
 	config.IPFile = *ipInput
+	config.Proxy = *proxyFlag
+	config.Interface = *ifaceFlag
 	config.ExpectedCode = *expected
 	config.MaxRepeat = *repeat
 	config.RepeatDelay = *retryDelay
@@ -105,10 +233,85 @@ func Main() int {
 	config.ReLookup = *relookup
 	config.CertExpiryError = mc.Dur(*expiryThreshold)
 	config.Insecure = *insecure
-	config.CAFile = *caCertFlag
+	config.CADir = *caPathFlag
+	config.CAAppendSystem = *caAppendFlag
 	config.Cert = *certFlag
 	config.Key = *keyFlag
+	if !certPassword(*passEnvFlag, *passFileFlag) {
+		return 1 // error already logged
+	}
+	config.TLSOnly = *tlsOnly
+	config.TLSResume = *tlsResume
+	config.TCP = *tcpFlag
+	config.ExpectedBanner = *expectBanner
+	config.SNI = *sni
+	config.RequireOCSPStaple = *requireOCSP
+	var err error
+	if config.LocalAddrs, err = mc.ParseLocalAddrs(*localAddrFlag); err != nil {
+		return log.FErrf("Invalid -local-addr: %v", err)
+	}
+	if config.TLSMinVersion, err = mc.ParseTLSVersion(*tlsMin); err != nil {
+		return log.FErrf("Invalid -tls-min: %v", err)
+	}
+	if config.TLSMaxVersion, err = mc.ParseTLSVersion(*tlsMax); err != nil {
+		return log.FErrf("Invalid -tls-max: %v", err)
+	}
+	if config.ExpectedTLSVersion, err = mc.ParseTLSVersion(*expectTLS); err != nil {
+		return log.FErrf("Invalid -expect-tls: %v", err)
+	}
+	if config.CipherSuites, err = mc.ParseCipherSuites(*ciphers); err != nil {
+		return log.FErrf("Invalid -ciphers: %v", err)
+	}
+	if config.ForbiddenTLSVersions, err = mc.ParseTLSVersions(*tlsForbid); err != nil {
+		return log.FErrf("Invalid -tls-forbid: %v", err)
+	}
+	numProto := 0
+	for _, f := range []bool{*http11Flag, *http2Flag, *h2cFlag, *http3Flag} {
+		if f {
+			numProto++
+		}
+	}
+	switch {
+	case numProto > 1:
+		return log.FErrf("Only one of -http1.1, -http2, -http2-prior-knowledge, -http3 can be used")
+	case *http3Flag:
+		config.HTTPProtocol = mc.ProtoHTTP3
+	case *http2Flag:
+		config.HTTPProtocol = mc.ProtoHTTP2
+	case *h2cFlag:
+		config.HTTPProtocol = mc.ProtoH2C
+	case *http11Flag:
+		config.HTTPProtocol = mc.ProtoHTTP1
+	}
+	config.FollowRedirects = *followFlag
+	config.MaxRedirects = *maxRedirs
+	config.RedirectResolve = *redirectResolve
+	config.AltSvcProbe = *altSvcProbe
+	if config.ExpectedProto, err = mc.ParseProto(*expectProto); err != nil {
+		return log.FErrf("Invalid -expect-proto: %v", err)
+	}
+	config.TLSScanCiphers = *tlsScanCiphers
+	config.TLSScan = *tlsScan || config.TLSScanCiphers || len(config.ForbiddenTLSVersions) > 0
+	config.CompareCerts = *compareCerts || *compareChain
+	config.CompareCertChain = *compareChain
 	config.NoProgressBar = *noBarFlag
+	config.MaxBodySize = *maxBodyFlag
+	config.MaxBodySizeError = *maxBodyErrFlag
+	config.HashAlgorithm = *hashFlag
+	expectedHashes := []struct{ algo, value string }{{"sha256", *expSha256}, {"sha1", *expSha1}, {"md5", *expMd5}}
+	for _, exp := range expectedHashes {
+		if exp.value == "" {
+			continue
+		}
+		if config.ExpectedHash != "" || (config.HashAlgorithm != "" && !strings.EqualFold(config.HashAlgorithm, exp.algo)) {
+			return log.FErrf("Only one of -expect-sha256, -expect-sha1, -expect-md5 (matching -hash if set) can be used")
+		}
+		config.HashAlgorithm = exp.algo
+		config.ExpectedHash = expectedHash(exp.value)
+		if config.ExpectedHash == "" {
+			return 1 // error already logged
+		}
+	}
 	if *data != "" {
 		if config.Method == "" {
 			config.Method = http.MethodPost
@@ -122,6 +325,19 @@ func Main() int {
 		config.Method = http.MethodGet
 	}
 	log.Debugf("Config: %+v", config)
+	if *vhosts != "" {
+		list := vhostsList(*vhosts)
+		if list == nil {
+			return 1 // error already logged
+		}
+		exitCode, results := mc.MultiCurlVHosts(ctx, config, list)
+		log.Infof("Virtual hosts: %d, errors: %d, warnings %d", len(list), results.Errors, results.Warnings)
+		if *jsonFlag {
+			j, _ := json.MarshalIndent(results, "", "  ") //nolint:errchkjson // https://github.com/breml/errchkjson/issues/22
+			os.Stdout.Write(append(j, '\n'))
+		}
+		return exitCode
+	}
 	exitCode, results := mc.MultiCurl(ctx, config)
 	log.Debugf("Results: %+v", results)
 	log.Infof("Total iterations: %d, errors: %d, warnings %d", results.Iterations, results.Errors, results.Warnings)
@@ -145,3 +361,79 @@ func payload(dataStr string) []byte {
 	log.Infof("Read %d bytes from %q as payload", len(data), fname)
 	return data
 }
+
+// expectedHash returns the digest from the flag value or from the first word of the file
+// if the value starts with @ (ie the format of sha256sum and similar tools output).
+func expectedHash(value string) string {
+	if value[0] != '@' {
+		return value
+	}
+	fname := value[1:]
+	data, err := os.ReadFile(fname)
+	if err != nil {
+		log.FErrf("Unable to read expected hash from file %q: %v", fname, err)
+		return ""
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) == 0 {
+		log.FErrf("No hash found in file %q", fname)
+		return ""
+	}
+	log.Infof("Read expected hash %s from %q", fields[0], fname)
+	return fields[0]
+}
+
+// vhostsList returns the comma separated list of virtual hosts or the ones from the file (one per line,
+// # comments allowed) if the value starts with @.
+func vhostsList(value string) []string {
+	var list []string
+	if value[0] != '@' {
+		list = strings.Split(value, ",")
+	} else {
+		fname := value[1:]
+		data, err := os.ReadFile(fname)
+		if err != nil {
+			log.FErrf("Unable to read virtual hosts from file %q: %v", fname, err)
+			return nil
+		}
+		list = strings.Split(string(data), "\n")
+	}
+	var vhosts []string
+	for _, v := range list {
+		v = strings.TrimSpace(v)
+		if v == "" || strings.HasPrefix(v, "#") {
+			continue
+		}
+		vhosts = append(vhosts, v)
+	}
+	if len(vhosts) == 0 {
+		log.FErrf("No virtual host found in %q", value)
+		return nil
+	}
+	return vhosts
+}
+
+// certPassword sets the config.CertPassword from the environment variable or the file (first line).
+func certPassword(envVar, fname string) bool {
+	if envVar != "" && fname != "" {
+		log.FErrf("Only one of -pass-env and -pass-file can be used")
+		return false
+	}
+	if envVar != "" {
+		pass, found := os.LookupEnv(envVar)
+		if !found {
+			log.FErrf("Password environment variable %q not set", envVar)
+			return false
+		}
+		config.CertPassword = pass
+	}
+	if fname != "" {
+		data, err := os.ReadFile(fname)
+		if err != nil {
+			log.FErrf("Unable to read password file %q: %v", fname, err)
+			return false
+		}
+		config.CertPassword = strings.TrimRight(strings.SplitN(string(data), "\n", 2)[0], "\r")
+	}
+	return true
+}
@@ -1,6 +1,6 @@
 module fortio.org/multicurl
 
-go 1.20
+go 1.26.0
 
 require (
 	fortio.org/cli v1.12.3
@@ -8,12 +8,19 @@ require (
 	fortio.org/progressbar v1.2.0
 	fortio.org/testscript v0.3.2
 	fortio.org/version v1.0.4
+	github.com/quic-go/quic-go v0.63.0
+	github.com/youmark/pkcs8 v0.0.0-20240726163527-a2c0da244d78
+	golang.org/x/crypto v0.57.0
+	golang.org/x/net v0.58.0
+	software.sslmate.com/src/go-pkcs12 v0.7.3
 )
 
 require (
 	fortio.org/struct2env v0.4.2 // indirect
 	github.com/kortschak/goroutine v1.1.3 // indirect
+	github.com/quic-go/qpack v0.6.0 // indirect
 	golang.org/x/crypto/x509roots/fallback v0.0.0-20250203165127-fa5273e46196 // indirect
-	golang.org/x/sys v0.25.0 // indirect
-	golang.org/x/tools v0.24.0 // indirect
+	golang.org/x/sys v0.48.0 // indirect
+	golang.org/x/text v0.42.0 // indirect
+	golang.org/x/tools v0.49.0 // indirect
 )
@@ -0,0 +1,352 @@
+// Copyright 2023 Fortio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mc
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"fortio.org/cli"
+	"fortio.org/log"
+)
+
+// AltSvcGroups keys for addresses not sending any Alt-Svc header and for the ones sending `clear`.
+const (
+	NoAltSvc    = "none"
+	ClearAltSvc = "clear"
+)
+
+// ErrUnsupportedAltSvc is the AltSvcProbe error for protocols which can't be probed (e.g drafts like h3-29).
+var ErrUnsupportedAltSvc = errors.New("unsupported protocol")
+
+// AltSvc is one alternative service advertised in an Alt-Svc response header (RFC 7838).
+type AltSvc struct {
+	// Protocol is the ALPN protocol id, e.g `h3` or `h2`.
+	Protocol string
+	// Host of the alternative, empty means the same host (and thus the same IP).
+	Host string `json:",omitempty"`
+	// Port of the alternative.
+	Port int
+	// MaxAge is the `ma` parameter in seconds, 0 if absent.
+	MaxAge int `json:",omitempty"`
+}
+
+// String returns the alternative in Alt-Svc header syntax (without parameters), e.g `h3=":443"`.
+func (a AltSvc) String() string {
+	return fmt.Sprintf("%s=%q", a.Protocol, net.JoinHostPort(a.Host, strconv.Itoa(a.Port)))
+}
+
+// AltSvcProbe is the result of the follow-up request to an alternative service.
+type AltSvcProbe struct {
+	AltSvc
+	// Target is the address connected to.
+	Target string
+	// Code is the http status code, -1 on error, 0 if skipped.
+	Code int
+	// Proto is the protocol of the response.
+	Proto string `json:",omitempty"`
+	// Error if the request failed.
+	Error string `json:",omitempty"`
+}
+
+// ParseAltSvc parses the values of Alt-Svc headers (RFC 7838 section 3). A `clear` value returns an empty,
+// non nil, list.
+func ParseAltSvc(values []string) ([]AltSvc, error) {
+	res := []AltSvc{}
+	for _, v := range values {
+		for _, entry := range splitQuoted(v, ',') {
+			entry = strings.TrimSpace(entry)
+			if entry == "" || entry == "clear" {
+				continue
+			}
+			alt, err := parseAltValue(entry)
+			if err != nil {
+				return nil, err
+			}
+			res = append(res, alt)
+		}
+	}
+	return res, nil
+}
+
+// parseAltValue parses one `protocol-id="[host]:port"; param=value...` entry.
+func parseAltValue(entry string) (AltSvc, error) {
+	params := splitQuoted(entry, ';')
+	proto, authority, found := strings.Cut(params[0], "=")
+	proto = strings.TrimSpace(proto)
+	if !found || !isToken(proto) {
+		return AltSvc{}, fmt.Errorf("invalid Alt-Svc entry %q, expecting protocol=\"host:port\"", entry)
+	}
+	proto, err := url.PathUnescape(proto)
+	if err != nil {
+		return AltSvc{}, fmt.Errorf("invalid Alt-Svc protocol in %q: %w", entry, err)
+	}
+	authority, err = unquoteString(strings.TrimSpace(authority))
+	if err != nil {
+		return AltSvc{}, fmt.Errorf("invalid Alt-Svc authority in %q: %w", entry, err)
+	}
+	host, port, err := net.SplitHostPort(authority)
+	if err != nil {
+		return AltSvc{}, fmt.Errorf("invalid Alt-Svc authority in %q: %w", entry, err)
+	}
+	alt := AltSvc{Protocol: proto, Host: host}
+	if alt.Port, err = strconv.Atoi(port); err != nil {
+		return AltSvc{}, fmt.Errorf("invalid Alt-Svc port in %q: %w", entry, err)
+	}
+	for _, p := range params[1:] {
+		k, v, found := strings.Cut(strings.TrimSpace(p), "=")
+		if !found || !isToken(k) {
+			return AltSvc{}, fmt.Errorf("invalid Alt-Svc parameter %q in %q", p, entry)
+		}
+		if strings.HasPrefix(v, `"`) {
+			v, err = unquoteString(v)
+		} else if !isToken(v) {
+			err = fmt.Errorf("invalid value %q", v)
+		}
+		if err != nil {
+			return AltSvc{}, fmt.Errorf("invalid Alt-Svc parameter %s in %q: %w", k, entry, err)
+		}
+		if k == "ma" {
+			if alt.MaxAge, err = strconv.Atoi(v); err != nil {
+				return AltSvc{}, fmt.Errorf("invalid Alt-Svc max age in %q: %w", entry, err)
+			}
+		}
+	}
+	return alt, nil
+}
+
+// splitQuoted splits s on sep, except within quoted-strings (RFC 9110 section 5.6.4).
+func splitQuoted(s string, sep byte) []string {
+	var parts []string
+	start := 0
+	inQuotes, escaped := false, false
+	for i := range len(s) {
+		c := s[i]
+		switch {
+		case escaped:
+			escaped = false
+		case inQuotes && c == '\\':
+			escaped = true
+		case c == '"':
+			inQuotes = !inQuotes
+		case !inQuotes && c == sep:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// unquoteString returns the content of the quoted-string s, unescaping its quoted-pairs (RFC 9110 section 5.6.4).
+func unquoteString(s string) (string, error) {
+	if len(s) < 2 || s[0] != '"' || s[len(s)-1] != '"' {
+		return "", fmt.Errorf("expecting a quoted string, got %s", s)
+	}
+	var b strings.Builder
+	s = s[1 : len(s)-1]
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+			if i == len(s) {
+				return "", fmt.Errorf("unterminated quoted string")
+			}
+		case '"':
+			return "", fmt.Errorf("unexpected quote in quoted string")
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String(), nil
+}
+
+// isToken returns true if s is a non empty token (RFC 9110 section 5.6.2).
+func isToken(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range []byte(s) {
+		if !strings.ContainsRune("!#$%&'*+-.^_`|~", rune(c)) &&
+			(c < '0' || c > '9') && (c < 'a' || c > 'z') && (c < 'A' || c > 'Z') {
+			return false
+		}
+	}
+	return true
+}
+
+// recordAltSvc parses and records the Alt-Svc headers of the response from aStr.
+// Returns the alternatives and the number of warnings (unparsable header).
+func recordAltSvc(i int, result *ResultStats, aStr string, resp *http.Response) ([]AltSvc, int) {
+	values := resp.Header.Values("Alt-Svc")
+	if len(values) == 0 {
+		delete(result.AltSvc, aStr)
+		return nil, 0
+	}
+	alts, err := ParseAltSvc(values)
+	if err != nil {
+		log.Warnf("%d: Bad Alt-Svc from %s: %v", i, aStr, err)
+		delete(result.AltSvc, aStr)
+		return nil, 1
+	}
+	log.Infof("%d: Alt-Svc from %s: %v", i, aStr, alts)
+	result.AltSvc[aStr] = alts
+	return alts, 0
+}
+
+// probeAltSvcs makes the request again to each of the alternatives advertised by the target,
+// still connecting to its IP when the alternative's host is empty (https urls only). Returns the number of errors.
+func probeAltSvcs(i int, cfg *Config, result *ResultStats, t *target, req *http.Request,
+	tlsConfig *tls.Config, alts []AltSvc,
+) int {
+	aStr := t.key
+	if req.URL.Scheme != "https" {
+		log.Infof("%d: Not probing the Alt-Svc of %s, only done for https urls", i, aStr)
+		delete(result.AltSvcProbes, aStr)
+		return 0
+	}
+	numErrors := 0
+	probes := make([]*AltSvcProbe, 0, len(alts))
+	for _, alt := range alts {
+		probe := &AltSvcProbe{AltSvc: alt, Target: net.JoinHostPort(alt.Host, strconv.Itoa(alt.Port))}
+		if alt.Host == "" {
+			probe.Target = IPPortString(t.ip, alt.Port)
+		}
+		probes = append(probes, probe)
+		err := probeAltSvc(i, cfg, t, req, tlsConfig, probe)
+		if errors.Is(err, ErrUnsupportedAltSvc) {
+			log.Warnf("%d: Skipping Alt-Svc %v of %s: %v", i, alt, aStr, err)
+			probe.Error = err.Error()
+			continue
+		}
+		if err != nil {
+			log.Errf("%d: Alt-Svc %v of %s error: %v", i, alt, aStr, err)
+			probe.Code = -1
+			probe.Error = err.Error()
+			numErrors++
+			continue
+		}
+		log.Infof("%d: Alt-Svc %v of %s: %s %d from %s", i, alt, aStr, probe.Proto, probe.Code, probe.Target)
+	}
+	result.AltSvcProbes[aStr] = probes
+	return numErrors
+}
+
+func probeAltSvc(i int, cfg *Config, t *target, req *http.Request, tlsConfig *tls.Config, probe *AltSvcProbe) error {
+	var rt http.RoundTripper
+	switch probe.Protocol {
+	case "h3":
+		if cfg.proxyURL != nil {
+			return fmt.Errorf("%w %q through a proxy", ErrUnsupportedAltSvc, probe.Protocol)
+		}
+		h3tr, closeH3 := newHTTP3Transport(i, cfg, tlsConfig, t.local, probe.Target, &HTTP3Info{}, nil)
+		defer closeH3()
+		rt = h3tr
+	case "h2", "http/1.1":
+		tr := &http.Transport{
+			DisableKeepAlives: true,
+			Proxy:             nil, // dial() goes through cfg.Proxy if set
+			TLSClientConfig:   tlsConfig.Clone(),
+			Protocols:         &http.Protocols{},
+			DialContext: func(ctx context.Context, network, oAddr string) (net.Conn, error) {
+				log.LogVf("%d: DialContext %s %s -> %s", i, network, oAddr, probe.Target)
+				return dial(ctx, i, cfg, t, network, probe.Target)
+			},
+		}
+		tr.TLSClientConfig.NextProtos = []string{probe.Protocol}
+		if cfg.SNI == NoSNI {
+			tr.DialTLSContext = noSNIDialTLS(tr.TLSClientConfig, tr.DialContext)
+		}
+		tr.Protocols.SetHTTP1(probe.Protocol == "http/1.1")
+		tr.Protocols.SetHTTP2(probe.Protocol == "h2")
+		rt = tr
+	default:
+		return fmt.Errorf("%w %q", ErrUnsupportedAltSvc, probe.Protocol)
+	}
+	hcli := http.Client{
+		Transport: rt,
+		Timeout:   cfg.RequestTimeout,
+		CheckRedirect: func(_ *http.Request, _ []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	r := req.Clone(req.Context())
+	if cfg.Payload != nil {
+		r.Body = io.NopCloser(bytes.NewReader(cfg.Payload))
+	}
+	resp, err := hcli.Do(r)
+	if err != nil {
+		return err
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	probe.Code = resp.StatusCode
+	probe.Proto = resp.Proto
+	return nil
+}
+
+// checkAltSvcConsistency groups the addresses by the Alt-Svc they advertised and returns false
+// if they don't all advertise the same ones.
+func checkAltSvcConsistency(result *ResultStats) bool {
+	if len(result.AltSvc) == 0 {
+		return true
+	}
+	result.AltSvcGroups = make(map[string][]string)
+	for addr := range result.Codes {
+		if result.Codes[addr] < 0 {
+			continue
+		}
+		key := NoAltSvc
+		if alts, found := result.AltSvc[addr]; found {
+			key = altSvcKey(alts)
+		}
+		result.AltSvcGroups[key] = append(result.AltSvcGroups[key], addr)
+	}
+	if len(result.AltSvcGroups) <= 1 {
+		n := len(result.AltSvc)
+		log.Infof("All %d %s advertised the same Alt-Svc", n, cli.PluralExt(n, "address", "es"))
+		return true
+	}
+	keys := make([]string, 0, len(result.AltSvcGroups))
+	for k, addrs := range result.AltSvcGroups {
+		sort.Strings(addrs)
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		log.Warnf("Different Alt-Svc %q advertised by %v", k, result.AltSvcGroups[k])
+	}
+	return false
+}
+
+// altSvcKey is the AltSvcGroups key for the alternatives.
+func altSvcKey(alts []AltSvc) string {
+	if len(alts) == 0 {
+		return ClearAltSvc
+	}
+	list := make([]string, 0, len(alts))
+	for _, a := range alts {
+		list = append(list, a.String())
+	}
+	return strings.Join(list, ", ")
+}
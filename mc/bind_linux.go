@@ -0,0 +1,39 @@
+// Copyright 2023 Fortio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux
+
+package mc
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// bindToDevice returns the dialer/listener Control function binding the sockets to the network
+// interface (SO_BINDTODEVICE).
+func bindToDevice(iface string) (func(network, address string, c syscall.RawConn) error, error) {
+	return func(_, _ string, c syscall.RawConn) error {
+		var err error
+		if cerr := c.Control(func(fd uintptr) {
+			err = syscall.SetsockoptString(int(fd), syscall.SOL_SOCKET, syscall.SO_BINDTODEVICE, iface)
+		}); cerr != nil {
+			return cerr
+		}
+		if err != nil {
+			return fmt.Errorf("binding to interface %s: %w", iface, err)
+		}
+		return nil
+	}, nil
+}
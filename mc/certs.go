@@ -0,0 +1,204 @@
+// Copyright 2023 Fortio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mc
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"fortio.org/log"
+
+	"github.com/youmark/pkcs8"
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+// ErrIncorrectPassword is returned (wrapped) when the client certificate or key can't be decrypted
+// with the provided password, as opposed to the file being malformed.
+var ErrIncorrectPassword = errors.New("incorrect password")
+
+// loadPKCS12 loads a client certificate, its key and chain from a PKCS#12 (.p12/.pfx) file.
+func loadPKCS12(fname, password string) (tls.Certificate, error) {
+	data, err := os.ReadFile(fname)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	key, cert, chain, err := pkcs12.DecodeChain(data, password)
+	if err != nil {
+		if errors.Is(err, pkcs12.ErrIncorrectPassword) {
+			return tls.Certificate{}, fmt.Errorf("%w for PKCS#12 file %s", ErrIncorrectPassword, fname)
+		}
+		return tls.Certificate{}, fmt.Errorf("malformed PKCS#12 file %s: %w", fname, err)
+	}
+	c := tls.Certificate{
+		Certificate: [][]byte{cert.Raw},
+		PrivateKey:  key,
+		Leaf:        cert,
+	}
+	for _, ca := range chain {
+		c.Certificate = append(c.Certificate, ca.Raw)
+	}
+	return c, nil
+}
+
+// loadKeyPair is like tls.LoadX509KeyPair but also supports encrypted keys
+// (PKCS#8 "ENCRYPTED PRIVATE KEY" or legacy "Proc-Type: 4,ENCRYPTED" PEM) using the password.
+func loadKeyPair(certFile, keyFile, password string) (tls.Certificate, error) {
+	certPEM, err := os.ReadFile(certFile)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	keyPEM, err := os.ReadFile(keyFile)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	keyPEM, err = decryptKeyPEM(keyFile, keyPEM, password)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.X509KeyPair(certPEM, keyPEM)
+}
+
+// decryptKeyPEM returns the PEM data unchanged if the key isn't encrypted or a PEM
+// encoded PKCS#8 unencrypted version of the key otherwise.
+func decryptKeyPEM(keyFile string, keyPEM []byte, password string) ([]byte, error) {
+	rest := keyPEM
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			return keyPEM, nil // not encrypted (or not PEM), let tls.X509KeyPair deal with it
+		}
+		var der []byte
+		switch {
+		case block.Type == "ENCRYPTED PRIVATE KEY":
+			key, err := pkcs8.ParsePKCS8PrivateKey(block.Bytes, []byte(password))
+			if err != nil {
+				return nil, keyError(keyFile, password, err)
+			}
+			der, err = x509.MarshalPKCS8PrivateKey(key)
+			if err != nil {
+				return nil, err
+			}
+			block = &pem.Block{Type: "PRIVATE KEY", Bytes: der}
+		case x509.IsEncryptedPEMBlock(block): //nolint:staticcheck // legacy format still in use
+			der, err := x509.DecryptPEMBlock(block, []byte(password)) //nolint:staticcheck // legacy format still in use
+			if err != nil {
+				return nil, keyError(keyFile, password, err)
+			}
+			block = &pem.Block{Type: block.Type, Bytes: der}
+		default:
+			continue
+		}
+		return pem.EncodeToMemory(block), nil
+	}
+}
+
+func keyError(keyFile, password string, err error) error {
+	if password == "" {
+		return fmt.Errorf("key %s is encrypted and no password was provided: %w", keyFile, ErrIncorrectPassword)
+	}
+	if errors.Is(err, x509.IncorrectPasswordError) || strings.Contains(err.Error(), "incorrect password") {
+		return fmt.Errorf("%w for key %s", ErrIncorrectPassword, keyFile)
+	}
+	return fmt.Errorf("malformed encrypted key %s: %w", keyFile, err)
+}
+
+// isPEM returns true if the file looks like PEM (vs binary PKCS#12).
+func isPEM(fname string) bool {
+	data, err := os.ReadFile(fname)
+	return err == nil && bytes.Contains(data, []byte("-----BEGIN "))
+}
+
+// LoadCAs returns a pool of the CAs from the files and the files in dir (optionally in addition to the system ones),
+// along with a map of the custom CAs fingerprint to the file they came from.
+// Returns nil (ie use the system CAs) if there are no files nor dir.
+func LoadCAs(files []string, dir string, withSystem bool) (*x509.CertPool, map[string]string, error) {
+	if len(files) == 0 && dir == "" {
+		return nil, nil, nil
+	}
+	pool := x509.NewCertPool()
+	if withSystem {
+		sysPool, err := x509.SystemCertPool()
+		if err != nil {
+			log.Warnf("Unable to load system CAs, using only custom ones: %v", err)
+		} else {
+			pool = sysPool
+		}
+	}
+	sources := make(map[string]string)
+	for _, f := range files {
+		n, err := addCAs(pool, sources, f)
+		if err != nil || n == 0 {
+			if err == nil {
+				err = fmt.Errorf("no certificate found in %s", f)
+			}
+			return nil, nil, fmt.Errorf("can't read CA file: %w", err)
+		}
+	}
+	if dir != "" {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			return nil, nil, fmt.Errorf("can't read CA directory: %w", err)
+		}
+		total := 0
+		for _, e := range entries {
+			if e.IsDir() {
+				continue
+			}
+			n, err := addCAs(pool, sources, filepath.Join(dir, e.Name()))
+			if err != nil {
+				return nil, nil, fmt.Errorf("can't read CA directory file: %w", err)
+			}
+			total += n
+		}
+		log.LogVf("Loaded %d CAs from directory %s", total, dir)
+	}
+	return pool, sources, nil
+}
+
+// addCAs adds the PEM certificates in fname to the pool and records their source. Returns the number added.
+func addCAs(pool *x509.CertPool, sources map[string]string, fname string) (int, error) {
+	data, err := os.ReadFile(fname)
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return n, fmt.Errorf("invalid certificate in %s: %w", fname, err)
+		}
+		pool.AddCert(cert)
+		sources[Fingerprint(cert)] = fname
+		n++
+	}
+	log.LogVf("Loaded %d CAs from %s", n, fname)
+	return n, nil
+}
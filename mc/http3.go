@@ -0,0 +1,113 @@
+// Copyright 2023 Fortio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mc
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"time"
+
+	"fortio.org/log"
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+)
+
+// HTTP3Info is the outcome of the HTTP/3 (QUIC) request to an address.
+type HTTP3Info struct {
+	// Success is true if a response was received over HTTP/3.
+	Success bool
+	// Error connecting or sending the request, if any.
+	Error string `json:",omitempty"`
+	// Code is the http status code of the response.
+	Code int `json:",omitempty"`
+	// Handshake is the duration of the QUIC (and TLS) handshake.
+	Handshake time.Duration
+	// FirstByte is the duration until the response headers are received.
+	FirstByte time.Duration
+	// Total is the duration until the response body is fully read.
+	Total time.Duration
+}
+
+// newHTTP3Transport returns a (single use) HTTP/3 transport connecting over UDP to aStr instead of the url's host,
+// from the local address if not nil, recording the handshake time in info and calling onDial (if not nil)
+// with the local address. The returned function closes the transport.
+func newHTTP3Transport(i int, cfg *Config, tlsConfig *tls.Config, local net.IP, aStr string, info *HTTP3Info,
+	onDial func(local net.Addr),
+) (*http3.Transport, func()) {
+	var udpConns []net.PacketConn
+	h3tr := &http3.Transport{
+		TLSClientConfig: tlsConfig,
+		Dial: func(ctx context.Context, oAddr string, tlsCfg *tls.Config, qCfg *quic.Config) (*quic.Conn, error) {
+			log.LogVf("%d: Dial quic %s -> %s", i, oAddr, aStr)
+			if cfg.SNI == NoSNI {
+				tlsCfg.ServerName = "" // IPs aren't sent as SNI (and quic-go sets the one from aStr)
+			}
+			start := time.Now()
+			c, err := dialQUIC(ctx, cfg, local, aStr, tlsCfg, qCfg, &udpConns)
+			info.Handshake = time.Since(start)
+			if c != nil {
+				log.LogVf("%d: Dial quic %v", i, c.LocalAddr())
+				if onDial != nil {
+					onDial(c.LocalAddr())
+				}
+			}
+			return c, err
+		},
+	}
+	return h3tr, func() {
+		h3tr.Close()
+		for _, c := range udpConns {
+			c.Close()
+		}
+	}
+}
+
+// dialQUIC is quic.DialAddr but from the local address, or the one the system picks for aStr when nil
+// (so the recorded local address isn't the unspecified one), and bound to the Interface if set.
+// The UDP socket is added to udpConns for the caller to close.
+func dialQUIC(ctx context.Context, cfg *Config, local net.IP, aStr string, tlsCfg *tls.Config, qCfg *quic.Config,
+	udpConns *[]net.PacketConn,
+) (*quic.Conn, error) {
+	raddr, err := net.ResolveUDPAddr("udp", aStr)
+	if err != nil {
+		return nil, err
+	}
+	if local == nil {
+		// "connecting" UDP doesn't send anything, it only selects the source address
+		d := net.Dialer{Control: cfg.bindControl}
+		var c net.Conn
+		if c, err = d.DialContext(ctx, "udp", aStr); err != nil {
+			return nil, err
+		}
+		local = c.LocalAddr().(*net.UDPAddr).IP
+		c.Close()
+	}
+	lc := net.ListenConfig{Control: cfg.bindControl}
+	udp, err := lc.ListenPacket(ctx, "udp", net.JoinHostPort(local.String(), "0"))
+	if err != nil {
+		return nil, err
+	}
+	*udpConns = append(*udpConns, udp)
+	return quic.Dial(ctx, udp, raddr, tlsCfg, qCfg)
+}
+
+func logHTTP3(i int, aStr string, info *HTTP3Info) {
+	if !info.Success {
+		return // error already logged
+	}
+	log.Infof("%d: HTTP/3 %d from %s: handshake %v, first byte %v, total %v", i, info.Code, aStr,
+		info.Handshake.Round(time.Microsecond), info.FirstByte.Round(time.Microsecond), info.Total.Round(time.Microsecond))
+}
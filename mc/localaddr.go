@@ -0,0 +1,146 @@
+// Copyright 2023 Fortio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mc
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// AllLocalAddrs is the ParseLocalAddrs value for all the global unicast addresses of the up interfaces.
+const AllLocalAddrs = "all"
+
+// InterfaceAddrs returns the IP addresses of the named network interface.
+func InterfaceAddrs(name string) ([]net.IP, error) {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, err
+	}
+	var ips []net.IP
+	for _, a := range addrs {
+		if ipnet, ok := a.(*net.IPNet); ok && !ipnet.IP.IsLinkLocalUnicast() {
+			ips = append(ips, ipnet.IP)
+		}
+	}
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("no usable address on interface %s", name)
+	}
+	return ips, nil
+}
+
+// allLocalAddrs returns the global unicast addresses of the interfaces which are up.
+func allLocalAddrs() ([]net.IP, error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	var ips []net.IP
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			return nil, err
+		}
+		for _, a := range addrs {
+			if ipnet, ok := a.(*net.IPNet); ok && ipnet.IP.IsGlobalUnicast() {
+				ips = append(ips, ipnet.IP)
+			}
+		}
+	}
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("no global unicast local address found")
+	}
+	return ips, nil
+}
+
+// ParseLocalAddrs parses a comma separated list of local IPs and/or interface names (for all their addresses),
+// or AllLocalAddrs. Empty string returns nil.
+func ParseLocalAddrs(list string) ([]net.IP, error) {
+	if list == "" {
+		return nil, nil
+	}
+	if list == AllLocalAddrs {
+		return allLocalAddrs()
+	}
+	var ips []net.IP
+	for _, s := range strings.Split(list, ",") {
+		s = strings.TrimSpace(s)
+		if ip := net.ParseIP(s); ip != nil {
+			ips = append(ips, ip)
+			continue
+		}
+		addrs, err := InterfaceAddrs(s)
+		if err != nil {
+			return nil, fmt.Errorf("%q is neither an IP nor a usable interface: %w", s, err)
+		}
+		ips = append(ips, addrs...)
+	}
+	return ips, nil
+}
+
+// localAddrsFor returns the LocalAddrs of the same family as addr, a single nil (default) if LocalAddrs is empty.
+func (cfg *Config) localAddrsFor(addr net.IP) []net.IP {
+	if len(cfg.LocalAddrs) == 0 {
+		return []net.IP{nil}
+	}
+	var res []net.IP
+	for _, l := range cfg.LocalAddrs {
+		if (l.To4() == nil) == (addr.To4() == nil) {
+			res = append(res, l)
+		}
+	}
+	return res
+}
+
+// sweepsLocalAddrs is true when some targets are tried from more than one local address,
+// the results are then keyed by `ip:port@local`.
+func (cfg *Config) sweepsLocalAddrs() bool {
+	n4, n6 := 0, 0
+	for _, l := range cfg.LocalAddrs {
+		if l.To4() != nil {
+			n4++
+		} else {
+			n6++
+		}
+	}
+	return n4 > 1 || n6 > 1
+}
+
+// target is one of the IPs to query (from one of its local addresses) or one of the unix sockets.
+type target struct {
+	ip net.IP
+	// local address to connect from, nil for the default
+	local net.IP
+	// unix socket path to connect to instead of ip
+	socket string
+	// results key: `ip:port`, `ip:port@local` when sweeping local addresses or `unix:path`
+	key string
+}
+
+// newTarget returns the target for addr from local (sweep being sweepsLocalAddrs).
+func (cfg *Config) newTarget(addr, local net.IP, sweep bool) *target {
+	t := &target{ip: addr, local: local, key: IPPortString(addr, cfg.portNum)}
+	if sweep {
+		t.key += "@" + local.String()
+	}
+	return t
+}
@@ -0,0 +1,101 @@
+// Copyright 2023 Fortio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mc
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"fortio.org/log"
+)
+
+// Values for Config.HTTPProtocol.
+const (
+	// ProtoHTTP1 only uses HTTP/1.1.
+	ProtoHTTP1 = "http/1.1"
+	// ProtoHTTP2 negotiates HTTP/2 over TLS using ALPN, falling back to HTTP/1.1 (and plain HTTP/1.1 for http urls).
+	// This is the same as the default (empty).
+	ProtoHTTP2 = "h2"
+	// ProtoH2C uses HTTP/2 with prior knowledge: h2c (cleartext) for http urls, h2 without fallback over TLS.
+	ProtoH2C = "h2c"
+	// ProtoHTTP3 sends the request over QUIC (UDP) to each IP, results are also in ResultStats.HTTP3.
+	ProtoHTTP3 = "h3"
+)
+
+// ParseProto normalizes a protocol as found in http.Response.Proto, accepting short forms like
+// `1.1`, `2`, `h2` or `HTTP/2`. Empty string returns empty string.
+func ParseProto(p string) (string, error) {
+	if p == "" {
+		return "", nil
+	}
+	norm := strings.TrimSpace(strings.TrimPrefix(strings.ToUpper(p), "HTTP/"))
+	switch norm {
+	case "1.0":
+		return "HTTP/1.0", nil
+	case "1.1", "1":
+		return "HTTP/1.1", nil
+	case "2", "2.0", "H2", "H2C":
+		return "HTTP/2.0", nil
+	case "3", "3.0", "H3":
+		return "HTTP/3.0", nil
+	default:
+		return "", fmt.Errorf("invalid HTTP protocol %q, must be one of 1.0, 1.1, 2 or 3", p)
+	}
+}
+
+// setupProtocols configures the transport (and ALPN of tlsConfig) for cfg.HTTPProtocol.
+func (cfg *Config) setupProtocols(tr *http.Transport, tlsConfig *tls.Config) error {
+	protocols := &http.Protocols{}
+	switch cfg.HTTPProtocol {
+	case "":
+		// what go's default transport offers, set explicitly for TLSOnly handshakes and NoSNI's DialTLSContext.
+		tlsConfig.NextProtos = []string{"h2", "http/1.1"}
+		return nil
+	case ProtoHTTP3: // the HTTP/3 transport is setup for each request.
+		return nil
+	case ProtoHTTP1:
+		protocols.SetHTTP1(true)
+	case ProtoHTTP2:
+		protocols.SetHTTP1(true)
+		protocols.SetHTTP2(true)
+		tlsConfig.NextProtos = []string{"h2", "http/1.1"}
+	case ProtoH2C:
+		protocols.SetHTTP2(true)
+		protocols.SetUnencryptedHTTP2(true)
+		tlsConfig.NextProtos = []string{"h2"}
+	default:
+		return fmt.Errorf("invalid HTTP protocol %q, must be one of %s, %s, %s or %s",
+			cfg.HTTPProtocol, ProtoHTTP1, ProtoHTTP2, ProtoH2C, ProtoHTTP3)
+	}
+	tr.Protocols = protocols
+	return nil
+}
+
+// checkProto records the protocol of the response and returns 1 if it isn't the expected one.
+func checkProto(i int, cfg *Config, result *ResultStats, aStr string, resp *http.Response) int {
+	result.Protocols[aStr] = resp.Proto
+	if cfg.ExpectedProto == "" {
+		log.LogVf("%d: Protocol %s from %s", i, resp.Proto, aStr)
+		return 0
+	}
+	if resp.Proto != cfg.ExpectedProto {
+		log.Errf("%d: Protocol %s from %s, expected %s", i, resp.Proto, aStr, cfg.ExpectedProto)
+		return 1
+	}
+	log.Infof("%d: Protocol %s from %s as expected", i, resp.Proto, aStr)
+	return 0
+}
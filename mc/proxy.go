@@ -0,0 +1,126 @@
+// Copyright 2023 Fortio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mc
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// ParseProxy parses and validates a proxy url: `http://`, `https://` (CONNECT) or `socks5://` (`socks5h://`),
+// with optional `user:password@`. Empty string returns nil.
+func ParseProxy(p string) (*url.URL, error) {
+	if p == "" {
+		return nil, nil //nolint:nilnil // nil is no proxy
+	}
+	u, err := url.Parse(p)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy url %q: %w", p, err)
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5", "socks5h":
+	default:
+		return nil, fmt.Errorf("invalid proxy url %q, scheme must be one of http, https, socks5 or socks5h", p)
+	}
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("invalid proxy url %q, missing host", p)
+	}
+	if u.Port() == "" {
+		port := map[string]string{"http": "80", "https": "443", "socks5": "1080", "socks5h": "1080"}[u.Scheme]
+		u.Host = net.JoinHostPort(u.Hostname(), port)
+	}
+	return u, nil
+}
+
+// proxyDial connects to aStr (the target ip:port) through the proxy, using d to connect to the proxy.
+func proxyDial(ctx context.Context, d *net.Dialer, proxyURL *url.URL, network, aStr string) (net.Conn, error) {
+	if proxyURL.Scheme == "socks5" || proxyURL.Scheme == "socks5h" {
+		pd, err := proxy.FromURL(proxyURL, d)
+		if err != nil {
+			return nil, err
+		}
+		return pd.(proxy.ContextDialer).DialContext(ctx, network, aStr)
+	}
+	return connectDial(ctx, d, proxyURL, aStr)
+}
+
+// connectDial connects to the http(s) proxy and asks it to CONNECT to aStr.
+func connectDial(ctx context.Context, d *net.Dialer, proxyURL *url.URL, aStr string) (net.Conn, error) {
+	conn, err := d.DialContext(ctx, "tcp", proxyURL.Host)
+	if err != nil {
+		return nil, err
+	}
+	if proxyURL.Scheme == "https" {
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: proxyURL.Hostname()}) //nolint:gosec // go's default min
+		if err = tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("proxy %s TLS handshake: %w", proxyURL.Redacted(), err)
+		}
+		conn = tlsConn
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{}) //nolint:errcheck // best effort reset
+	}
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: aStr},
+		Host:   aStr,
+		Header: make(http.Header),
+	}
+	if u := proxyURL.User; u != nil {
+		pass, _ := u.Password()
+		auth := base64.StdEncoding.EncodeToString([]byte(u.Username() + ":" + pass))
+		req.Header.Set("Proxy-Authorization", "Basic "+auth)
+	}
+	if err = req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("proxy %s CONNECT %s: %w", proxyURL.Redacted(), aStr, err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("proxy %s CONNECT %s: %s", proxyURL.Redacted(), aStr, resp.Status)
+	}
+	if br.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, r: br}, nil
+	}
+	return conn, nil
+}
+
+// bufferedConn is a net.Conn whose reads start with what was already buffered.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
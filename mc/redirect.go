@@ -0,0 +1,138 @@
+// Copyright 2023 Fortio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mc
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"fortio.org/log"
+)
+
+// RedirectHop is one of the requests made when following redirects.
+type RedirectHop struct {
+	// URL requested.
+	URL string
+	// Address connected to.
+	Address string
+	// Code is the http status code, -1 on error.
+	Code int
+	// Location is the redirect target, if any.
+	Location string `json:",omitempty"`
+}
+
+// sameHost is true if u is for the url's host (or HostOverride) and should thus stay pinned to the same IP.
+func (cfg *Config) sameHost(u *url.URL) bool {
+	host := u.Hostname()
+	if host == cfg.host {
+		return true
+	}
+	if cfg.HostOverride == "" {
+		return false
+	}
+	override := cfg.HostOverride
+	if h, _, err := net.SplitHostPort(override); err == nil {
+		override = h
+	}
+	return host == override
+}
+
+// URLPort returns the port of u, defaulting to the scheme's one.
+func URLPort(u *url.URL) int {
+	if p, err := strconv.Atoi(u.Port()); err == nil {
+		return p
+	}
+	if u.Scheme == "https" {
+		return 443
+	}
+	return 80
+}
+
+// redirectTransport sends the requests for the same host to the pinned transport and the others
+// (cross host redirects) to the regular, resolving, one. Recording each request as a hop.
+type redirectTransport struct {
+	cfg    *Config
+	t      *target
+	pinned http.RoundTripper
+	other  *http.Transport
+	// remote address of the last connection of the other transport
+	otherAddr string
+	hops      []*RedirectHop
+}
+
+func (rt *redirectTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	hop := &RedirectHop{URL: req.URL.String()}
+	rt.hops = append(rt.hops, hop)
+	var resp *http.Response
+	var err error
+	if rt.cfg.sameHost(req.URL) {
+		hop.Address = IPPortString(rt.t.ip, URLPort(req.URL))
+		if rt.t.socket != "" {
+			hop.Address = rt.t.key
+		}
+		resp, err = rt.pinned.RoundTrip(req)
+	} else {
+		rt.otherAddr = ""
+		resp, err = rt.other.RoundTrip(req)
+		hop.Address = rt.otherAddr
+	}
+	if err != nil {
+		hop.Code = -1
+		return resp, err
+	}
+	hop.Code = resp.StatusCode
+	hop.Location = resp.Header.Get("Location")
+	return resp, nil
+}
+
+// followRedirects sets up cli to follow (up to cfg.MaxRedirects) redirects, staying pinned to the target's IP
+// for the same host. Returns the transport recording the hops.
+func followRedirects(i int, cfg *Config, t *target, tr *http.Transport, cli *http.Client) *redirectTransport {
+	other := tr.Clone()
+	other.Proxy = nil          // dial() goes through cfg.Proxy if set
+	other.DialTLSContext = nil // the NoSNI one dials the pinned address
+	other.TLSClientConfig.ServerName = ""
+	other.TLSClientConfig.VerifyConnection = nil
+	other.TLSClientConfig.InsecureSkipVerify = cfg.Insecure //nolint:gosec // on purpose with the flag/config
+	rt := &redirectTransport{cfg: cfg, t: t, pinned: cli.Transport, other: other}
+	other.DialContext = func(ctx context.Context, network, oAddr string) (net.Conn, error) {
+		c, err := dial(ctx, i, cfg, t, network, oAddr)
+		if c != nil {
+			rt.otherAddr = c.RemoteAddr().String()
+			if cfg.proxyURL != nil {
+				rt.otherAddr = oAddr // RemoteAddr is the proxy's
+			}
+		}
+		return c, err
+	}
+	cli.Transport = rt
+	cli.CheckRedirect = func(next *http.Request, via []*http.Request) error {
+		if len(via) > cfg.MaxRedirects {
+			return fmt.Errorf("stopped after %d redirects", cfg.MaxRedirects)
+		}
+		// the other transport would also dial the unix socket
+		if !cfg.sameHost(next.URL) && (!cfg.RedirectResolve || t.socket != "") {
+			log.Warnf("%d: Not following %d redirect to other host %s", i, next.Response.StatusCode, next.URL)
+			return http.ErrUseLastResponse
+		}
+		log.Infof("%d: Following %d redirect to %s", i, next.Response.StatusCode, next.URL)
+		return nil
+	}
+	return rt
+}
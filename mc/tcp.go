@@ -0,0 +1,123 @@
+// Copyright 2023 Fortio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mc
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"slices"
+	"time"
+
+	"fortio.org/log"
+)
+
+// MaxBannerSize is the maximum number of bytes read for the banner in TCP mode.
+const MaxBannerSize = 64 * 1024
+
+// TCPInfo is the outcome of the TCP (Config.TCP mode) probe of an address.
+type TCPInfo struct {
+	// Connect is the duration of the TCP connection establishment.
+	Connect time.Duration
+	// Total is the duration until the banner was read (or connect if there is no payload or expected banner).
+	Total time.Duration
+	// Banner is what was read from the connection, if anything.
+	Banner string `json:",omitempty"`
+	// Error connecting, sending the payload or reading the banner, if any.
+	Error string `json:",omitempty"`
+}
+
+// oneTCP connects to the target, sends the Payload if any and reads the banner (if there is a payload or an
+// ExpectedBanner to match). Returns the number of errors (0 or 1).
+func oneTCP(ctx context.Context, i int, cfg *Config, result *ResultStats, t *target) int {
+	aStr := t.key
+	name := t.name()
+	info := &TCPInfo{}
+	result.TCP[aStr] = info
+	ctx, cancel := context.WithTimeout(ctx, cfg.RequestTimeout)
+	defer cancel()
+	start := time.Now()
+	conn, err := dial(ctx, i, cfg, t, "tcp", cfg.dialTarget(t))
+	info.Connect = time.Since(start)
+	info.Total = info.Connect
+	if err != nil {
+		log.Errf("%d: Error connecting to %s: %v", i, name, err)
+		info.Error = err.Error()
+		result.Codes[aStr] = -1
+		return 1
+	}
+	defer conn.Close()
+	result.LocalAddrs[aStr] = conn.LocalAddr().String()
+	if cfg.Payload == nil && cfg.bannerRegexp == nil {
+		log.Infof("%d: Connected to %s in %v", i, name, info.Connect.Round(time.Microsecond))
+		delete(result.Codes, aStr)
+		return 0
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	if cfg.Payload != nil {
+		log.LogVf("%d: Sending payload of %d bytes", i, len(cfg.Payload))
+		if _, err = conn.Write(cfg.Payload); err != nil {
+			log.Errf("%d: Error sending payload to %s: %v", i, name, err)
+			info.Error = err.Error()
+			result.Codes[aStr] = -1
+			return 1
+		}
+	}
+	banner, err := readBanner(conn, cfg)
+	info.Total = time.Since(start)
+	info.Banner = string(banner)
+	if err != nil {
+		log.Errf("%d: Error reading banner from %s: %v", i, name, err)
+		info.Error = err.Error()
+		result.Codes[aStr] = -1
+		return 1
+	}
+	if cfg.bannerRegexp != nil && !cfg.bannerRegexp.Match(banner) {
+		log.Errf("%d: Banner from %s %q doesn't match expected %q", i, name, banner, cfg.ExpectedBanner)
+		info.Error = "unexpected banner"
+		result.Codes[aStr] = -1
+		return 1
+	}
+	delete(result.Codes, aStr)
+	log.Infof("%d: Connected to %s in %v, banner %q in %v", i, name,
+		info.Connect.Round(time.Microsecond), banner, info.Total.Round(time.Microsecond))
+	return 0
+}
+
+// readBanner reads from conn until the ExpectedBanner matches (or, without one, the first read), the
+// connection is closed, the deadline is reached or MaxBannerSize is read.
+// Timeout and EOF after some data are not errors.
+func readBanner(conn net.Conn, cfg *Config) ([]byte, error) {
+	buf := make([]byte, 0, 4096)
+	for len(buf) < MaxBannerSize {
+		buf = slices.Grow(buf, 4096)
+		n, err := conn.Read(buf[len(buf):min(cap(buf), MaxBannerSize)])
+		buf = buf[:len(buf)+n]
+		if n > 0 && (cfg.bannerRegexp == nil || cfg.bannerRegexp.Match(buf)) {
+			return buf, nil
+		}
+		if err != nil {
+			if len(buf) > 0 && (errors.Is(err, io.EOF) || errors.Is(err, os.ErrDeadlineExceeded)) {
+				err = nil // what we got is the banner (checked by the caller)
+			}
+			return buf, err
+		}
+	}
+	return buf, nil
+}
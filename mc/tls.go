@@ -0,0 +1,584 @@
+// Copyright 2023 Fortio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mc
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"fortio.org/cli"
+	"fortio.org/log"
+	"golang.org/x/crypto/ocsp"
+)
+
+// NoSNI is the Config.SNI value to not send any server name indication.
+const NoSNI = "none"
+
+// CertInfo is the details of a certificate presented by a server.
+type CertInfo struct {
+	Subject            string
+	Issuer             string
+	DNSNames           []string `json:"DNSNames,omitempty"`
+	IPAddresses        []string `json:"IPAddresses,omitempty"`
+	SerialNumber       string
+	KeyType            string
+	KeySize            int
+	SignatureAlgorithm string
+	NotBefore          time.Time
+	NotAfter           time.Time
+	// Hex encoded sha256 of the DER certificate.
+	SHA256Fingerprint string
+	// Base64 encoded sha256 of the public key (SPKI), as used for pinning.
+	SPKISHA256 string
+}
+
+// TLSInfo is the TLS connection details for one address.
+type TLSInfo struct {
+	// Server name sent in the handshake (empty when none).
+	SNI string `json:"SNI,omitempty"`
+	// Negotiated TLS version (e.g. "TLS 1.3").
+	Version string
+	// Negotiated cipher suite.
+	CipherSuite string
+	// Negotiated ALPN protocol if any.
+	ALPN string `json:"ALPN,omitempty"`
+	// Whether the session was resumed (only with Config.TLSResume).
+	DidResume bool
+	// Stapled OCSP response details.
+	OCSP *OCSPInfo `json:"OCSP,omitempty"`
+	// Host name the certificate was verified against.
+	VerifiedHost string
+	// Result of the chain and host name verification, which is done even when using Insecure.
+	CertValid bool
+	// Verification error if not CertValid.
+	CertError string `json:"CertError,omitempty"`
+	// Subject of the root CA the (first) chain was verified against and where that CA came from:
+	// "system" or the custom CA file.
+	VerifiedRoot       string `json:"VerifiedRoot,omitempty"`
+	VerifiedRootSource string `json:"VerifiedRootSource,omitempty"`
+	// Certificates presented by the server, leaf first.
+	PeerCertificates []CertInfo
+	// Verified chains (empty when the certificate isn't valid).
+	VerifiedChains [][]CertInfo `json:"VerifiedChains,omitempty"`
+}
+
+// OCSPInfo is the details of the OCSP response stapled by the server (if any).
+type OCSPInfo struct {
+	// Whether the server stapled an OCSP response.
+	Stapled bool
+	// Status of the leaf certificate: good, revoked or unknown.
+	Status     string     `json:"Status,omitempty"`
+	ProducedAt *time.Time `json:"ProducedAt,omitempty"`
+	ThisUpdate *time.Time `json:"ThisUpdate,omitempty"`
+	NextUpdate *time.Time `json:"NextUpdate,omitempty"`
+	RevokedAt  *time.Time `json:"RevokedAt,omitempty"`
+	// Error parsing or validating the stapled response, if any.
+	Error string `json:"Error,omitempty"`
+}
+
+// NewOCSPInfo parses the stapled OCSP response of the connection (checking its signature
+// when the issuer is available).
+func NewOCSPInfo(cs *tls.ConnectionState) *OCSPInfo {
+	info := &OCSPInfo{Stapled: len(cs.OCSPResponse) > 0}
+	if !info.Stapled || len(cs.PeerCertificates) == 0 {
+		return info
+	}
+	var issuer *x509.Certificate
+	switch {
+	case len(cs.VerifiedChains) > 0 && len(cs.VerifiedChains[0]) > 1:
+		issuer = cs.VerifiedChains[0][1]
+	case len(cs.PeerCertificates) > 1:
+		issuer = cs.PeerCertificates[1]
+	}
+	resp, err := ocsp.ParseResponseForCert(cs.OCSPResponse, cs.PeerCertificates[0], issuer)
+	if err != nil {
+		info.Error = err.Error()
+		return info
+	}
+	switch resp.Status {
+	case ocsp.Good:
+		info.Status = "good"
+	case ocsp.Revoked:
+		info.Status = "revoked"
+		info.RevokedAt = &resp.RevokedAt
+	default:
+		info.Status = "unknown"
+	}
+	info.ProducedAt = &resp.ProducedAt
+	info.ThisUpdate = &resp.ThisUpdate
+	if !resp.NextUpdate.IsZero() {
+		info.NextUpdate = &resp.NextUpdate
+	}
+	return info
+}
+
+// checkOCSP logs the stapled OCSP response status and returns the number of errors and warnings:
+// an error if the certificate is revoked, a warning if the staple is invalid or stale (errors when
+// Config.RequireOCSPStaple, which also makes a missing or not good staple an error).
+func checkOCSP(i int, cfg *Config, aStr string, info *OCSPInfo) (int, int) {
+	// only enforced with RequireOCSPStaple
+	level, numErrors, numWarnings := log.Warning, 0, 1
+	if cfg.RequireOCSPStaple {
+		level, numErrors, numWarnings = log.Error, 1, 0
+	}
+	switch {
+	case !info.Stapled:
+		if cfg.RequireOCSPStaple {
+			log.Errf("%d: No OCSP response stapled by %s", i, aStr)
+			return 1, 0
+		}
+		log.LogVf("%d: No OCSP response stapled by %s", i, aStr)
+		return 0, 0
+	case info.Error != "":
+		log.Logf(level, "%d: Invalid OCSP response stapled by %s: %s", i, aStr, info.Error)
+		return numErrors, numWarnings
+	case info.Status == "revoked":
+		log.Errf("%d: OCSP stapled by %s says certificate revoked at %s", i, aStr, info.RevokedAt)
+		return 1, 0
+	case info.NextUpdate != nil && info.NextUpdate.Before(cfg.now):
+		log.Logf(level, "%d: Stale OCSP response stapled by %s: next update was %s", i, aStr, info.NextUpdate)
+		return numErrors, numWarnings
+	case info.Status != "good" && cfg.RequireOCSPStaple:
+		log.Errf("%d: OCSP stapled by %s has status %s", i, aStr, info.Status)
+		return 1, 0
+	}
+	log.Infof("%d: OCSP stapled by %s: %s, next update %s", i, aStr, info.Status, info.NextUpdate)
+	return 0, 0
+}
+
+// Fingerprint returns the hex encoded sha256 of the certificate.
+func Fingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// SPKIHash returns the base64 encoded sha256 of the certificate's public key (curl's pinnedpubkey format).
+func SPKIHash(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// AddPin validates and adds public key pins in curl's `sha256//base64` format,
+// multiple pins can be separated by `;`.
+func (cfg *Config) AddPin(pins string) error {
+	for _, pin := range strings.Split(pins, ";") {
+		pin = strings.TrimSpace(pin)
+		b64, found := strings.CutPrefix(pin, "sha256//")
+		if !found {
+			return fmt.Errorf("invalid pin %q, expecting sha256//base64", pin)
+		}
+		if b, err := base64.StdEncoding.DecodeString(b64); err != nil || len(b) != sha256.Size {
+			return fmt.Errorf("invalid pin %q, not a base64 encoded sha256", pin)
+		}
+		log.LogVf("Adding public key pin %s", b64)
+		cfg.Pins = append(cfg.Pins, b64)
+	}
+	return nil
+}
+
+// serverName is the tls.Config.ServerName to use (empty means the url's host, or none with NoSNI).
+func (cfg *Config) serverName() string {
+	switch cfg.SNI {
+	case "":
+		return cfg.HostOverride
+	case NoSNI:
+		return ""
+	default:
+		return cfg.SNI
+	}
+}
+
+// verifyHost is the name the certificate must be valid for.
+func (cfg *Config) verifyHost() string {
+	if cfg.HostOverride != "" {
+		return cfg.HostOverride
+	}
+	return cfg.host
+}
+
+// sniUsed is the server name indication actually sent (empty if none).
+func (cfg *Config) sniUsed() string {
+	if cfg.SNI == NoSNI {
+		return ""
+	}
+	name := cfg.serverName()
+	if name == "" {
+		name = cfg.host
+	}
+	if net.ParseIP(name) != nil {
+		return ""
+	}
+	return name
+}
+
+// setupVerification sets tlsConfig.VerifyConnection for the checks go doesn't do on its own: public key pins
+// and, when the SNI differs from the Host (or there is none), the verification of the certificate against the Host.
+func (cfg *Config) setupVerification(tlsConfig *tls.Config) {
+	verifyHost := !cfg.Insecure && cfg.SNI != ""
+	if !verifyHost && len(cfg.Pins) == 0 {
+		return
+	}
+	roots := tlsConfig.RootCAs
+	if verifyHost {
+		// go would verify against the SNI name (and refuses to handshake without one),
+		// we do it ourselves against the Host instead.
+		tlsConfig.InsecureSkipVerify = true
+	}
+	tlsConfig.VerifyConnection = func(cs tls.ConnectionState) error {
+		if verifyHost {
+			if _, err := VerifyChain(&cs, roots, cfg.verifyHost()); err != nil {
+				return err
+			}
+		}
+		if len(cfg.Pins) > 0 {
+			return cfg.verifyPins(cs)
+		}
+		return nil
+	}
+}
+
+// VerifyChain verifies the presented certificates chain against the roots (system ones if nil) and the host name.
+func VerifyChain(cs *tls.ConnectionState, roots *x509.CertPool, host string) ([][]*x509.Certificate, error) {
+	if len(cs.PeerCertificates) == 0 {
+		return nil, fmt.Errorf("no certificate presented")
+	}
+	opts := x509.VerifyOptions{
+		Roots:         roots,
+		DNSName:       host,
+		Intermediates: x509.NewCertPool(),
+	}
+	for _, cert := range cs.PeerCertificates[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	return cs.PeerCertificates[0].Verify(opts)
+}
+
+// noSNIDialTLS returns an http.Transport.DialTLSContext for NoSNI, as the transport would otherwise
+// use the url's host as tlsConfig.ServerName and send it.
+func noSNIDialTLS(tlsConfig *tls.Config,
+	dial func(ctx context.Context, network, addr string) (net.Conn, error),
+) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		tlsConn := tls.Client(conn, tlsConfig.Clone())
+		if err = tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return tlsConn, nil
+	}
+}
+
+// verifyPins is used as tls.Config.VerifyConnection to fail the handshake when none of the
+// presented certificates' public key match one of the pins.
+func (cfg *Config) verifyPins(cs tls.ConnectionState) error {
+	for _, cert := range cs.PeerCertificates {
+		h := SPKIHash(cert)
+		for _, pin := range cfg.Pins {
+			if h == pin {
+				log.LogVf("Public key pin %s matches %q", pin, cert.Subject)
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("none of the %d presented certificates match the public key pins", len(cs.PeerCertificates))
+}
+
+// KeyTypeAndSize returns the type (RSA, ECDSA, Ed25519) and size in bits of the certificate's public key.
+func KeyTypeAndSize(cert *x509.Certificate) (string, int) {
+	switch pub := cert.PublicKey.(type) {
+	case *rsa.PublicKey:
+		return "RSA", pub.N.BitLen()
+	case *ecdsa.PublicKey:
+		return "ECDSA", pub.Curve.Params().BitSize
+	case ed25519.PublicKey:
+		return "Ed25519", 8 * len(pub)
+	default:
+		return cert.PublicKeyAlgorithm.String(), 0
+	}
+}
+
+// NewCertInfo extracts the CertInfo from a certificate.
+func NewCertInfo(cert *x509.Certificate) CertInfo {
+	keyType, keySize := KeyTypeAndSize(cert)
+	ci := CertInfo{
+		Subject:            cert.Subject.String(),
+		Issuer:             cert.Issuer.String(),
+		DNSNames:           cert.DNSNames,
+		SerialNumber:       cert.SerialNumber.Text(16),
+		KeyType:            keyType,
+		KeySize:            keySize,
+		SignatureAlgorithm: cert.SignatureAlgorithm.String(),
+		NotBefore:          cert.NotBefore,
+		NotAfter:           cert.NotAfter,
+		SHA256Fingerprint:  Fingerprint(cert),
+		SPKISHA256:         SPKIHash(cert),
+	}
+	for _, ip := range cert.IPAddresses {
+		ci.IPAddresses = append(ci.IPAddresses, ip.String())
+	}
+	return ci
+}
+
+// NewTLSInfo extracts the TLSInfo from the connection state.
+func NewTLSInfo(cs *tls.ConnectionState) *TLSInfo {
+	info := &TLSInfo{
+		Version:     tls.VersionName(cs.Version),
+		CipherSuite: tls.CipherSuiteName(cs.CipherSuite),
+		ALPN:        cs.NegotiatedProtocol,
+		DidResume:   cs.DidResume,
+	}
+	for _, cert := range cs.PeerCertificates {
+		info.PeerCertificates = append(info.PeerCertificates, NewCertInfo(cert))
+	}
+	info.VerifiedChains = chainsInfo(cs.VerifiedChains)
+	return info
+}
+
+func chainsInfo(chains [][]*x509.Certificate) [][]CertInfo {
+	var res [][]CertInfo
+	for _, chain := range chains {
+		var c []CertInfo
+		for _, cert := range chain {
+			c = append(c, NewCertInfo(cert))
+		}
+		res = append(res, c)
+	}
+	return res
+}
+
+// recordTLS logs the certificates expiration and saves the TLS details of the connection to aStr.
+// Returns the number of errors (unexpected TLS version, OCSP) and warnings (OCSP).
+func recordTLS(i int, cfg *Config, result *ResultStats, aStr string, cs *tls.ConnectionState) (int, int) {
+	numErrors := 0
+	level := log.Verbose
+	if cfg.ExpectedTLSVersion != 0 {
+		level = log.Info
+		if cs.Version != cfg.ExpectedTLSVersion {
+			level = log.Error
+			numErrors++
+		}
+	}
+	log.Logf(level, "%d: Negotiated %s %s (alpn %q, resumed %t) with %s", i, tls.VersionName(cs.Version),
+		tls.CipherSuiteName(cs.CipherSuite), cs.NegotiatedProtocol, cs.DidResume, aStr)
+	// Print certificate expiration date
+	for _, cert := range cs.PeerCertificates {
+		if result.ShortestCertExpiry == nil || cert.NotAfter.Before(*result.ShortestCertExpiry) {
+			result.ShortestCertExpiry = &cert.NotAfter
+		}
+		durDays := Days(cert.NotAfter.Sub(cfg.now))
+		log.Infof("Certificate %q expires in %.0f days", cert.Subject, durDays)
+		log.LogVf("Certificate %q issued by %q, sha256 fingerprint %s", cert.Subject, cert.Issuer, Fingerprint(cert))
+	}
+	// Always verify ourselves so we know what's wrong even with Insecure (or what would be with a different SNI).
+	verifiedHost := cfg.verifyHost()
+	chains, err := VerifyChain(cs, cfg.roots, verifiedHost)
+	if err == nil && len(cs.VerifiedChains) == 0 {
+		// go didn't verify (Insecure or done by setupVerification's VerifyConnection)
+		cs.VerifiedChains = chains
+	}
+	info := NewTLSInfo(cs)
+	info.SNI = cfg.sniUsed()
+	info.VerifiedHost = verifiedHost
+	if err != nil {
+		info.CertError = err.Error()
+		log.Warnf("%d: Certificate from %s isn't valid for %s: %v", i, aStr, info.VerifiedHost, err)
+	} else {
+		info.CertValid = true
+		log.LogVf("%d: Certificate from %s is valid for %s", i, aStr, info.VerifiedHost)
+		root := chains[0][len(chains[0])-1]
+		info.VerifiedRoot = root.Subject.String()
+		info.VerifiedRootSource = "system"
+		if src, found := cfg.caSources[Fingerprint(root)]; found {
+			info.VerifiedRootSource = src
+		}
+		log.LogVf("%d: Certificate from %s verified by root %q from %s", i, aStr, info.VerifiedRoot, info.VerifiedRootSource)
+	}
+	info.OCSP = NewOCSPInfo(cs)
+	nErr, numWarnings := checkOCSP(i, cfg, aStr, info.OCSP)
+	result.TLS[aStr] = info
+	return numErrors + nErr, numWarnings
+}
+
+// oneHandshake connects to the target and completes the TLS handshake, without any HTTP.
+// Returns the number of errors and warnings.
+func oneHandshake(ctx context.Context, i int, cfg *Config, result *ResultStats, t *target,
+	tlsConfig *tls.Config,
+) (int, int) {
+	aStr := t.key
+	log.LogVf("%d: TLS handshake with %s", i, aStr)
+	cs, local, err := handshake(ctx, i, cfg, t, tlsConfig)
+	if local != nil {
+		result.LocalAddrs[aStr] = local.String()
+	}
+	if err != nil {
+		log.Errf("%d: TLS handshake error with %s: %v", i, t.name(), err)
+		result.Codes[aStr] = -1
+		delete(result.TLS, aStr)
+		return 1, 0
+	}
+	log.Infof("%d: TLS handshake ok with %s (%s, %s)",
+		i, t.name(), tls.VersionName(cs.Version), tls.CipherSuiteName(cs.CipherSuite))
+	delete(result.Codes, aStr)
+	return recordTLS(i, cfg, result, aStr, &cs)
+}
+
+// handshake connects to the target and completes a TLS handshake using (a copy of) tlsConfig,
+// with the url's host as ServerName if not otherwise set (or NoSNI). Also returns the local address
+// of the connection: nil when connecting (directly or through the proxy) failed, the error is then
+// the connection's and not the handshake's.
+func handshake(ctx context.Context, i int, cfg *Config, t *target,
+	tlsConfig *tls.Config,
+) (tls.ConnectionState, net.Addr, error) {
+	conf := tlsConfig.Clone()
+	if conf.ServerName == "" && cfg.SNI != NoSNI {
+		conf.ServerName = cfg.host
+	}
+	ctx, cancel := context.WithTimeout(ctx, cfg.RequestTimeout)
+	defer cancel()
+	conn, err := dial(ctx, i, cfg, t, "tcp", cfg.dialTarget(t))
+	if err != nil {
+		return tls.ConnectionState{}, nil, err
+	}
+	defer conn.Close()
+	tlsConn := tls.Client(conn, conf)
+	if err = tlsConn.HandshakeContext(ctx); err != nil {
+		return tls.ConnectionState{}, conn.LocalAddr(), err
+	}
+	return tlsConn.ConnectionState(), conn.LocalAddr(), nil
+}
+
+// ParseTLSVersion parses a TLS version like "1.2", "TLS1.3" or "tls 1.3". Empty string returns 0.
+func ParseTLSVersion(v string) (uint16, error) {
+	if v == "" {
+		return 0, nil
+	}
+	norm := strings.TrimSpace(strings.TrimPrefix(strings.ToUpper(v), "TLS"))
+	switch norm {
+	case "1.0", "1":
+		return tls.VersionTLS10, nil
+	case "1.1":
+		return tls.VersionTLS11, nil
+	case "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	default:
+		return 0, fmt.Errorf("invalid TLS version %q, must be one of 1.0, 1.1, 1.2, 1.3", v)
+	}
+}
+
+// ParseTLSVersions parses a comma separated list of TLS versions (see ParseTLSVersion).
+func ParseTLSVersions(list string) ([]uint16, error) {
+	if list == "" {
+		return nil, nil
+	}
+	var versions []uint16
+	for _, v := range strings.Split(list, ",") {
+		version, err := ParseTLSVersion(v)
+		if err != nil {
+			return nil, err
+		}
+		versions = append(versions, version)
+	}
+	return versions, nil
+}
+
+// ParseCipherSuites parses a comma separated list of cipher suite names (as in tls.CipherSuiteName),
+// including the insecure ones. Empty string returns nil (go's defaults).
+func ParseCipherSuites(names string) ([]uint16, error) {
+	if names == "" {
+		return nil, nil
+	}
+	known := make(map[string]uint16)
+	for _, cs := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+		known[cs.Name] = cs.ID
+	}
+	var ids []uint16
+	for _, name := range strings.Split(names, ",") {
+		name = strings.TrimSpace(name)
+		id, found := known[strings.ToUpper(name)]
+		if !found {
+			return nil, fmt.Errorf("unknown cipher suite %q", name)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// CertKey returns the leaf fingerprint or, if fullChain, the comma separated fingerprints
+// of all presented certificates.
+func (info *TLSInfo) CertKey(fullChain bool) string {
+	if len(info.PeerCertificates) == 0 {
+		return ""
+	}
+	if !fullChain {
+		return info.PeerCertificates[0].SHA256Fingerprint
+	}
+	fps := make([]string, 0, len(info.PeerCertificates))
+	for _, c := range info.PeerCertificates {
+		fps = append(fps, c.SHA256Fingerprint)
+	}
+	return strings.Join(fps, ",")
+}
+
+// checkCertConsistency groups the addresses by certificate (see CertKey) in result.CertGroups
+// and returns true if all the addresses presented the same certificate(s).
+func checkCertConsistency(cfg *Config, result *ResultStats) bool {
+	result.CertGroups = make(map[string][]string)
+	subjects := make(map[string]string)
+	for addr, info := range result.TLS {
+		key := info.CertKey(cfg.CompareCertChain)
+		if key == "" {
+			continue
+		}
+		result.CertGroups[key] = append(result.CertGroups[key], addr)
+		subjects[key] = info.PeerCertificates[0].Subject
+	}
+	what := "certificate"
+	if cfg.CompareCertChain {
+		what = "certificate chain"
+	}
+	if len(result.CertGroups) <= 1 {
+		n := len(result.TLS)
+		log.Infof("All %d %s presented the same %s", n, cli.PluralExt(n, "address", "es"), what)
+		return true
+	}
+	keys := make([]string, 0, len(result.CertGroups))
+	for k, addrs := range result.CertGroups {
+		sort.Strings(addrs)
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		log.Errf("Different %s %q %s presented by %v", what, subjects[k], k, result.CertGroups[k])
+	}
+	return false
+}
@@ -0,0 +1,129 @@
+// Copyright 2023 Fortio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mc
+
+import (
+	"context"
+	"crypto/tls"
+	"strings"
+
+	"fortio.org/log"
+)
+
+// ScanVersions are the TLS versions tried by the TLS scan, in order.
+var ScanVersions = []uint16{tls.VersionTLS10, tls.VersionTLS11, tls.VersionTLS12, tls.VersionTLS13}
+
+// TLSScanResult is the protocol support matrix of one address.
+type TLSScanResult struct {
+	// TLS version name to whether a handshake with only that version succeeded.
+	Versions map[string]bool
+	// Cipher suite name to whether a (TLS 1.0-1.2) handshake with only that suite succeeded.
+	CipherSuites map[string]bool `json:"CipherSuites,omitempty"`
+}
+
+// oneScan tries a handshake with the target for each TLS version (and each cipher suite if Config.TLSScanCiphers).
+// Certificates aren't verified as only the protocol support is checked. Returns the number of errors
+// which is the number of Config.ForbiddenTLSVersions accepted (or 1 if the address can't be reached at all,
+// directly or through the proxy, or doesn't accept any TLS version).
+func oneScan(ctx context.Context, i int, cfg *Config, result *ResultStats, t *target, tlsConfig *tls.Config) int {
+	aStr := t.key
+	log.LogVf("%d: TLS scan of %s", i, aStr)
+	conf := tlsConfig.Clone()
+	conf.InsecureSkipVerify = true //nolint:gosec // only checking which protocols are accepted
+	conf.VerifyConnection = nil
+	conf.ClientSessionCache = nil
+	scan := &TLSScanResult{Versions: make(map[string]bool)}
+	numErrors := 0
+	numAccepted := 0
+	var summary []string
+	for _, v := range ScanVersions {
+		conf.MinVersion = v
+		conf.MaxVersion = v
+		conf.CipherSuites = nil
+		_, local, err := handshake(ctx, i, cfg, t, conf)
+		if local == nil {
+			// connecting (directly or through the proxy) failed, not the handshake
+			log.Errf("%d: Error connecting to %s: %v", i, t.name(), err)
+			result.Codes[aStr] = -1
+			return 1
+		}
+		result.LocalAddrs[aStr] = local.String() // only the port changes between the handshakes
+		name := tls.VersionName(v)
+		accepted := err == nil
+		scan.Versions[name] = accepted
+		status := "rejected"
+		if accepted {
+			numAccepted++
+			status = "accepted"
+			if isForbidden(cfg, v) {
+				log.Errf("%d: Forbidden %s accepted by %s", i, name, t.name())
+				numErrors++
+			}
+		} else {
+			log.LogVf("%d: %s rejected by %s: %v", i, name, t.name(), err)
+		}
+		summary = append(summary, name+": "+status)
+	}
+	log.Infof("%d: %s %s", i, t.name(), strings.Join(summary, ", "))
+	result.TLSScan[aStr] = scan
+	if numAccepted == 0 {
+		log.Errf("%d: %s doesn't accept any TLS version", i, t.name())
+		result.Codes[aStr] = -1
+		return 1
+	}
+	if cfg.TLSScanCiphers {
+		scanCiphers(ctx, i, cfg, t, conf, scan)
+	}
+	delete(result.Codes, aStr)
+	return numErrors
+}
+
+// scanCiphers tries each of go's TLS 1.0-1.2 cipher suites (TLS 1.3 suites aren't configurable).
+func scanCiphers(ctx context.Context, i int, cfg *Config, t *target, conf *tls.Config, scan *TLSScanResult) {
+	scan.CipherSuites = make(map[string]bool)
+	var accepted []string
+	for _, cs := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+		minVersion := uint16(0)
+		for _, v := range cs.SupportedVersions {
+			if v == tls.VersionTLS13 {
+				continue
+			}
+			if minVersion == 0 || v < minVersion {
+				minVersion = v
+			}
+		}
+		if minVersion == 0 {
+			continue // TLS 1.3 only suite
+		}
+		conf.MinVersion = minVersion
+		conf.MaxVersion = tls.VersionTLS12
+		conf.CipherSuites = []uint16{cs.ID}
+		_, _, err := handshake(ctx, i, cfg, t, conf)
+		scan.CipherSuites[cs.Name] = err == nil
+		if err == nil {
+			accepted = append(accepted, cs.Name)
+		}
+	}
+	log.Infof("%d: %s accepted cipher suites: %s", i, t.key, strings.Join(accepted, ", "))
+}
+
+func isForbidden(cfg *Config, v uint16) bool {
+	for _, f := range cfg.ForbiddenTLSVersions {
+		if f == v {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,47 @@
+// Copyright 2023 Fortio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mc
+
+import "strings"
+
+// UnixPrefix is the prefix of the unix domain socket entries in IP files (e.g `unix:/run/app.sock`,
+// or `unix:@name` for a Linux abstract socket) and in ResultStats.Addresses.
+const UnixPrefix = "unix:"
+
+// socketTarget returns the target for the unix socket path, keyed by `unix:path` (same as in ResultStats.Addresses).
+func socketTarget(path string) *target {
+	return &target{socket: path, key: UnixPrefix + path}
+}
+
+// name is the target for logs: the IP or `unix:path`.
+func (t *target) name() string {
+	if t.socket != "" {
+		return UnixPrefix + t.socket
+	}
+	return t.ip.String()
+}
+
+// dialTarget is the address to connect to for t: `ip:port` or the unix socket path.
+func (cfg *Config) dialTarget(t *target) string {
+	if t.socket != "" {
+		return t.socket
+	}
+	return IPPortString(t.ip, cfg.portNum)
+}
+
+// socketFileName turns a socket path into something usable in a file name (for {ip} in patterns).
+func socketFileName(path string) string {
+	return strings.ReplaceAll(strings.TrimLeft(path, "/@"), "/", "_")
+}
@@ -0,0 +1,134 @@
+// Copyright 2023 Fortio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mc
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"fortio.org/log"
+)
+
+// VHostResult is one cell of the virtual host × IP matrix.
+type VHostResult struct {
+	// http result code, -1 if the request failed.
+	Code int
+	// Whether the certificate presented is valid for the virtual host (https only).
+	CertValid *bool `json:"CertValid,omitempty"`
+}
+
+// VHostsResultStats is the result of MultiCurlVHosts.
+type VHostsResultStats struct {
+	// Total number of errors and warnings across all virtual hosts.
+	Errors   int
+	Warnings int
+	// Virtual hosts checked, in order.
+	VHosts []string
+	// Addresses queried (same for all virtual hosts).
+	Addresses []string
+	// Matrix of results: virtual host -> address (ip:port or unix:path) -> result.
+	Matrix map[string]map[string]VHostResult
+	// Full results for each virtual host.
+	Results map[string]ResultStats
+}
+
+// MultiCurlVHosts runs MultiCurl for each of the virtual hosts (as HostOverride, which also sets the SNI)
+// against the IPs of the url, resolved once. Returns the total number of errors and the vhost × IP matrix.
+func MultiCurlVHosts(ctx context.Context, cfg *Config, vhosts []string) (int, VHostsResultStats) {
+	stats := VHostsResultStats{
+		VHosts:  vhosts,
+		Matrix:  make(map[string]map[string]VHostResult),
+		Results: make(map[string]ResultStats),
+	}
+	if cfg.TCP {
+		return log.FErrf("TCP mode can't be used with virtual hosts"), stats
+	}
+	numErrors := 0
+	vcfg := *cfg
+	for _, vhost := range vhosts {
+		log.Infof("Checking virtual host %s", vhost)
+		vcfg.HostOverride = vhost
+		n, res := MultiCurl(ctx, &vcfg)
+		numErrors += n
+		stats.Errors += res.Errors
+		stats.Warnings += res.Warnings
+		stats.Results[vhost] = res
+		if res.Iterations == 0 {
+			return numErrors, stats // setup error, already logged and would be the same for all vhosts
+		}
+		if stats.Addresses == nil {
+			// resolve (or read the IPFile) only once, the next virtual hosts use the same IPs and unix sockets
+			stats.Addresses = res.Addresses
+			vcfg.Addresses, vcfg.UnixSockets = splitAddresses(res.Addresses)
+			vcfg.IPFile = "" // its entries are now in Addresses and UnixSockets
+		}
+		row := make(map[string]VHostResult)
+		for addr, code := range res.Codes {
+			cell := VHostResult{Code: code}
+			if info, found := res.TLS[addr]; found {
+				cell.CertValid = &info.CertValid
+			}
+			row[addr] = cell
+		}
+		stats.Matrix[vhost] = row
+	}
+	logMatrix(&stats, vcfg.portNum)
+	return numErrors, stats
+}
+
+// splitAddresses splits ResultStats.Addresses back into the IPs and the unix socket paths.
+func splitAddresses(addresses []string) ([]net.IP, []string) {
+	var ips []net.IP
+	var sockets []string
+	for _, a := range addresses {
+		if path, found := strings.CutPrefix(a, UnixPrefix); found {
+			sockets = append(sockets, path)
+			continue
+		}
+		ips = append(ips, net.ParseIP(a))
+	}
+	return ips, sockets
+}
+
+// logMatrix logs one line per virtual host with the result for each address.
+func logMatrix(stats *VHostsResultStats, port int) {
+	for _, vhost := range stats.VHosts {
+		row := stats.Matrix[vhost]
+		cells := make([]string, 0, len(row))
+		level := log.Info
+		for _, a := range stats.Addresses {
+			key := a // unix sockets are keyed by their Addresses entry
+			if !strings.HasPrefix(a, UnixPrefix) {
+				key = IPPortString(net.ParseIP(a), port)
+			}
+			cell, found := row[key]
+			if !found {
+				continue
+			}
+			c := fmt.Sprintf("%s=%d", a, cell.Code)
+			if cell.CertValid != nil && !*cell.CertValid {
+				c += " (invalid cert)"
+			}
+			if cell.Code != http.StatusOK || (cell.CertValid != nil && !*cell.CertValid) {
+				level = log.Warning
+			}
+			cells = append(cells, c)
+		}
+		log.Logf(level, "%s: %s", vhost, strings.Join(cells, ", "))
+	}
+}